@@ -8,13 +8,15 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"crypto/sha256"
 	"encoding/gob"
+	"math/big"
+	"sort"
+	"strconv"
 	"time"
 	"github.com/boltdb/bolt"
 )
 
-const dbFile = "blockchain.db"
+const dbFile = "blockchain_%s.db"
 const blocksBucket = "blocks"
 const CoinData = "Blockchain project"
 
@@ -25,6 +27,7 @@ type Block struct {
 	PreHash       []byte
 	Hash          []byte
 	Nonce         int
+	Difficulty    uint32
 }
 
 // Blockchain implements interactions with a DB
@@ -39,9 +42,13 @@ type BlockchainIterator struct {
 	db          *bolt.DB
 }
 
-// CreateBlock creates and returns Block
-func CreateBlock(transactions []*Transaction, preHash []byte) *Block {
-	block := &Block{time.Now().Unix(), transactions, preHash, []byte{}, 0}
+// initialDifficulty is the number of leading zero bits the genesis block
+// (and the very first retarget window) must satisfy
+const initialDifficulty = 16
+
+// CreateBlock creates and returns Block, mined at the given difficulty
+func CreateBlock(transactions []*Transaction, preHash []byte, difficulty uint32) *Block {
+	block := &Block{time.Now().Unix(), transactions, preHash, []byte{}, 0, difficulty}
 	pow := NewPOW(block)
 	nonce, hash := pow.Run()
 
@@ -53,20 +60,66 @@ func CreateBlock(transactions []*Transaction, preHash []byte) *Block {
 
 // CreateRootBlock creates and returns genesis Block
 func CreateRootBlock(coinbase *Transaction) *Block {
-	return CreateBlock([]*Transaction{coinbase}, []byte{})
+	return CreateBlock([]*Transaction{coinbase}, []byte{}, initialDifficulty)
 }
 
-// HashTransactions returns a hash of the transactions in the block
+// HashTransactions returns the Merkle root of the transactions in the block
 func (b *Block) HashTransactions() []byte {
 	var txHashes [][]byte
-	var txHash [32]byte
 
 	for _, tx := range b.Transactions {
 		txHashes = append(txHashes, tx.Hash())
 	}
-	txHash = sha256.Sum256(bytes.Join(txHashes, []byte{}))
 
-	return txHash[:]
+	tree := NewMerkleTree(txHashes)
+
+	return tree.RootNode.Data
+}
+
+// MerklePath returns the sibling hashes and left/right flags needed to
+// prove that the transaction identified by txID is included in the block,
+// without requiring the verifier to have the full block body
+func (b *Block) MerklePath(txID []byte) ([][]byte, []bool, error) {
+	var txHashes [][]byte
+	var leafHash []byte
+
+	for _, tx := range b.Transactions {
+		hash := tx.Hash()
+		txHashes = append(txHashes, hash)
+		if bytes.Compare(tx.Id, txID) == 0 {
+			leafHash = hash
+		}
+	}
+
+	if leafHash == nil {
+		return nil, nil, errors.New("transaction is not found in block")
+	}
+
+	tree := NewMerkleTree(txHashes)
+
+	var leaf *MerkleNode
+	for _, l := range tree.Leaves {
+		if bytes.Compare(l.Data, leafHash) == 0 {
+			leaf = l
+			break
+		}
+	}
+
+	var path [][]byte
+	var sides []bool
+
+	for node := leaf; node.Parent != nil; node = node.Parent {
+		parent := node.Parent
+		if parent.Left == node {
+			path = append(path, parent.Right.Data)
+			sides = append(sides, true) // sibling is the right node
+		} else {
+			path = append(path, parent.Left.Data)
+			sides = append(sides, false) // sibling is the left node
+		}
+	}
+
+	return path, sides, nil
 }
 
 // Serialize serializes the block
@@ -99,15 +152,16 @@ func Deserialization(d []byte) *Block {
 
 
 // CreateBlockchain creates a new blockchain DB
-func CreateBlockchain(address string) *Blockchain {
-	if dbExists() {
+func CreateBlockchain(address, nodeID string) *Blockchain {
+	dbFile := fmt.Sprintf(dbFile, nodeID)
+	if dbExists(dbFile) {
 		fmt.Println("Blockchain already exists.")
 		os.Exit(1)
 	}
 
 	var tip []byte
 
-	cbt := NewCoinTrans(address, CoinData)
+	cbt := NewCoinTrans(address, CoinData, 0)
 	root := CreateRootBlock(cbt)
 
 	db, err := bolt.Open(dbFile, 0600, nil)
@@ -139,12 +193,15 @@ func CreateBlockchain(address string) *Blockchain {
 
 	bc := Blockchain{tip, db}
 
+	UTXOSet{&bc}.Reindex()
+
 	return &bc
 }
 
 // NewBlockchain creates a new Blockchain with genesis Block
-func NewBlockchain(address string) *Blockchain {
-	if dbExists() == false {
+func NewBlockchain(nodeID string) *Blockchain {
+	dbFile := fmt.Sprintf(dbFile, nodeID)
+	if dbExists(dbFile) == false {
 		fmt.Println("No existing blockchain found. Create one first.")
 		os.Exit(1)
 	}
@@ -170,30 +227,6 @@ func NewBlockchain(address string) *Blockchain {
 	return &bc
 }
 
-// FindOutputs finds and returns unspent outputs to reference in inputs
-func (bc *Blockchain) FindOutputs(pubKH []byte, amount int) (int, map[string][]int) {
-	unspentOutputs := make(map[string][]int)
-	unspentTXs := bc.FindTrans(pubKH)
-	accumulated := 0
-
-Work:
-	for _, tx := range unspentTXs {
-		txID := hex.EncodeToString(tx.Id)
-
-		for outIdx, out := range tx.Vout {
-			if out.IsLockedWithKey(pubKH) && accumulated < amount {
-				accumulated += out.V
-				unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
-
-				if accumulated >= amount {
-					break Work
-				}
-			}
-		}
-	}
-	return accumulated, unspentOutputs
-}
-
 // FindTransaction finds a transaction by its ID
 func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 	bci := bc.Iterator()
@@ -214,77 +247,157 @@ func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 	return Transaction{}, errors.New("Transaction is not found")
 }
 
-// FindTrans returns a list of transactions containing unspent outputs
-func (bc *Blockchain) FindTrans(pubKeyHash []byte) []Transaction {
-	var unspentTXs []Transaction
-	spentTXOs := make(map[string][]int)
+// FindBlockContaining finds the block that includes the transaction with
+// the given ID, for building a Merkle proof
+func (bc *Blockchain) FindBlockContaining(txID []byte) (*Block, error) {
 	bci := bc.Iterator()
 
 	for {
 		block := bci.Next()
 
 		for _, tx := range block.Transactions {
-			txID := hex.EncodeToString(tx.Id)
-
-		Outputs:
-			for outIdx, out := range tx.Vout {
-				// Was the output spent?
-				if spentTXOs[txID] != nil {
-					for _, spentOutIdx := range spentTXOs[txID] {
-						if spentOutIdx == outIdx {
-							continue Outputs
-						}
-					}
-				}
-
-				if out.IsLockedWithKey(pubKeyHash) {
-					unspentTXs = append(unspentTXs, *tx)
-				}
+			if bytes.Compare(tx.Id, txID) == 0 {
+				return block, nil
 			}
+		}
+		if len(block.PreHash) == 0 {
+			break
+		}
+	}
 
-			if tx.IsCoinbase() == false {
-				for _, in := range tx.Vin {
-					if in.UsesKey(pubKeyHash) {
-						inTxID := hex.EncodeToString(in.Id)
-						spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Vout)
-					}
-				}
-			}
+	return nil, errors.New("transaction is not found in any block")
+}
+
+// Iterator returns a BlockchainIterat
+func (bc *Blockchain) Iterator() *BlockchainIterator {
+	bci := &BlockchainIterator{bc.Hash, bc.db}
+
+	return bci
+}
+
+// GetBlockHashes returns hashes of every block in the chain, tip first
+func (bc *Blockchain) GetBlockHashes() [][]byte {
+	var hashes [][]byte
+	bci := bc.Iterator()
+
+	for {
+		block := bci.Next()
+		hashes = append(hashes, block.Hash)
+
+		if len(block.PreHash) == 0 {
+			break
 		}
+	}
+
+	return hashes
+}
+
+// GetBestHeight returns the height of the tip block, counting the genesis
+// block as height 0 (one less than the number of blocks in the chain)
+func (bc *Blockchain) GetBestHeight() int {
+	height := 0
+	bci := bc.Iterator()
+
+	for {
+		block := bci.Next()
+		height++
 
 		if len(block.PreHash) == 0 {
 			break
 		}
 	}
 
-	return unspentTXs
+	return height - 1
 }
 
-// FindUTXO finds and returns all unspent transaction outputs
-func (bc *Blockchain) FindUTXO(pubKeyHash []byte) []TransOutput {
-	var UTXOs []TransOutput
-	unspentTransactions := bc.FindTrans(pubKeyHash)
+// GetBlock finds a block by its hash
+func (bc *Blockchain) GetBlock(hash []byte) (*Block, error) {
+	var block *Block
 
-	for _, tx := range unspentTransactions {
-		for _, out := range tx.Vout {
-			if out.IsLockedWithKey(pubKeyHash) {
-				UTXOs = append(UTXOs, out)
-			}
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blocksBucket))
+		encodedBlock := b.Get(hash)
+		if encodedBlock == nil {
+			return errors.New("block is not found")
 		}
+		block = Deserialization(encodedBlock)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return UTXOs
+	return block, nil
 }
 
-// Iterator returns a BlockchainIterat
-func (bc *Blockchain) Iterator() *BlockchainIterator {
-	bci := &BlockchainIterator{bc.Hash, bc.db}
+// retargetInterval is how often (in blocks) the difficulty is recalculated
+const retargetInterval = 10
 
-	return bci
+// targetBlockTime is the desired number of seconds between blocks
+const targetBlockTime = 10
+
+// maxAdjustmentFactor clamps how much the target can move in one retarget
+const maxAdjustmentFactor = 4
+
+// NextDifficulty returns the Difficulty the next block should be mined at.
+// Every retargetInterval blocks it compares the actual time spent mining
+// the last window against the desired span and scales the target
+// proportionally, clamped to maxAdjustmentFactor; otherwise it keeps the
+// current tip's difficulty unchanged.
+func (bc *Blockchain) NextDifficulty() uint32 {
+	tip, err := bc.GetBlock(bc.Hash)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	height := bc.GetBestHeight() + 1
+	if height%retargetInterval != 0 {
+		return tip.Difficulty
+	}
+
+	bci := bc.Iterator()
+	bci.Next() // the tip itself; already have it as newest
+
+	newest := tip
+	oldest := tip
+	for i := 0; i < retargetInterval; i++ {
+		oldest = bci.Next()
+		if len(oldest.PreHash) == 0 {
+			break
+		}
+	}
+
+	actualTimespan := newest.Time - oldest.Time
+	desiredTimespan := int64(retargetInterval * targetBlockTime)
+
+	if actualTimespan < desiredTimespan/maxAdjustmentFactor {
+		actualTimespan = desiredTimespan / maxAdjustmentFactor
+	}
+	if actualTimespan > desiredTimespan*maxAdjustmentFactor {
+		actualTimespan = desiredTimespan * maxAdjustmentFactor
+	}
+
+	oldTarget := big.NewInt(1)
+	oldTarget.Lsh(oldTarget, uint(256-tip.Difficulty))
+
+	newTarget := new(big.Int).Mul(oldTarget, big.NewInt(actualTimespan))
+	newTarget.Div(newTarget, big.NewInt(desiredTimespan))
+
+	// a target of 1<<(256-d) has BitLen 257-d
+	bits := 257 - newTarget.BitLen()
+	if bits < 1 {
+		bits = 1
+	}
+	if bits > 255 {
+		bits = 255
+	}
+
+	return uint32(bits)
 }
 
 // Mine mines a new block with the provided transactions
-func (bc *Blockchain) Mine(transactions []*Transaction) {
+func (bc *Blockchain) Mine(transactions []*Transaction) *Block {
 	var lastHash []byte
 
 	for _, tx := range transactions {
@@ -303,31 +416,61 @@ func (bc *Blockchain) Mine(transactions []*Transaction) {
 		log.Panic(err)
 	}
 
-	newBlock := CreateBlock(transactions, lastHash)
+	newBlock := CreateBlock(transactions, lastHash, bc.NextDifficulty())
+
+	bc.AddBlock(newBlock)
+
+	return newBlock
+}
 
-	err = bc.db.Update(func(tx *bolt.Tx) error {
+// AddBlock appends an already-mined block to the chain, either mined
+// locally or received from a peer, and keeps the UTXO set in sync
+func (bc *Blockchain) AddBlock(block *Block) {
+	err := bc.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blocksBucket))
-		err := b.Put(newBlock.Hash, newBlock.Serialization())
+		err := b.Put(block.Hash, block.Serialization())
 		if err != nil {
 			log.Panic(err)
 		}
 
-		err = b.Put([]byte("l"), newBlock.Hash)
+		err = b.Put([]byte("l"), block.Hash)
 		if err != nil {
 			log.Panic(err)
 		}
 
-		bc.Hash = newBlock.Hash
+		bc.Hash = block.Hash
 
 		return nil
 	})
 	if err != nil {
 		log.Panic(err)
 	}
+
+	UTXOSet{bc}.Update(block)
 }
 
 // SignTransaction signs inputs of a Transaction
 func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
+	prevTXs := bc.collectPrevTXs(tx)
+
+	tx.Sign(privKey, prevTXs)
+}
+
+// VerifyTransaction verifies transaction input signatures. A coinbase
+// transaction has no real inputs to look up, so it's valid by definition
+func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
+	if tx.IsCoinbase() {
+		return true
+	}
+
+	prevTXs := bc.collectPrevTXs(tx)
+
+	return tx.Verify(prevTXs)
+}
+
+// collectPrevTXs looks up every transaction referenced by tx's inputs, as
+// needed to sign, verify or fee-check it
+func (bc *Blockchain) collectPrevTXs(tx *Transaction) map[string]Transaction {
 	prevTXs := make(map[string]Transaction)
 
 	for _, vin := range tx.Vin {
@@ -338,25 +481,74 @@ func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey)
 		prevTXs[hex.EncodeToString(prevTX.Id)] = prevTX
 	}
 
-	tx.Sign(privKey, prevTXs)
+	return prevTXs
 }
 
-// VerifyTransaction verifies transaction input signatures
-func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
-	prevTXs := make(map[string]Transaction)
+// MaxBlockSize caps the serialized size, in bytes, of the transactions a
+// mined block may include (excluding the coinbase)
+var MaxBlockSize = 1000000
+
+// MineBlock selects candidate transactions by fee-per-byte, highest first,
+// up to MaxBlockSize, pays their combined fees to minerAddress via the
+// coinbase, and mines the resulting block
+func (bc *Blockchain) MineBlock(minerAddress string, txs []*Transaction) *Block {
+	type candidate struct {
+		tx   *Transaction
+		fee  int
+		size int
+	}
 
-	for _, vin := range tx.Vin {
-		prevTX, err := bc.FindTransaction(vin.Id)
-		if err != nil {
-			log.Panic(err)
+	var candidates []candidate
+	for _, tx := range txs {
+		if bc.VerifyTransaction(tx) != true {
+			log.Panic("ERROR: Invalid transaction")
 		}
-		prevTXs[hex.EncodeToString(prevTX.Id)] = prevTX
+
+		prevTXs := bc.collectPrevTXs(tx)
+		candidates = append(candidates, candidate{tx, tx.CalculateFee(prevTXs), len(tx.Serialize())})
 	}
 
-	return tx.Verify(prevTXs)
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].fee*candidates[j].size > candidates[j].fee*candidates[i].size
+	})
+
+	spent := make(map[string]bool)
+	var selected []*Transaction
+	totalFees := 0
+	size := 0
+	for _, c := range candidates {
+		if size+c.size > MaxBlockSize {
+			continue
+		}
+
+		conflict := false
+		for _, in := range c.tx.Vin {
+			outpoint := string(in.Id) + ":" + strconv.Itoa(in.Vout)
+			if spent[outpoint] {
+				conflict = true
+				break
+			}
+		}
+		if conflict {
+			continue
+		}
+		for _, in := range c.tx.Vin {
+			outpoint := string(in.Id) + ":" + strconv.Itoa(in.Vout)
+			spent[outpoint] = true
+		}
+
+		selected = append(selected, c.tx)
+		totalFees += c.fee
+		size += c.size
+	}
+
+	coinbase := NewCoinTrans(minerAddress, "", totalFees)
+	blockTxs := append([]*Transaction{coinbase}, selected...)
+
+	return bc.Mine(blockTxs)
 }
 
-func dbExists() bool {
+func dbExists(dbFile string) bool {
 	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
 		return false
 	}
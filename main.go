@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"log"
@@ -8,11 +9,11 @@ import (
 	"strconv"
 )
 
-func (cli *CLI) createBC(a string) {
+func (cli *CLI) createBC(a, nodeID string) {
 	if !CheckAddress(a) {
 		log.Panic("ERROR: Address is not valid")
 	}
-	bc := CreateBlockchain(a)
+	bc := CreateBlockchain(a, nodeID)
 	bc.db.Close()
 	fmt.Println("Done!")
 }
@@ -25,17 +26,18 @@ func (cli *CLI) createWallet() {
 	fmt.Printf("Your new address: %s\n", address)
 }
 
-func (cli *CLI) getBalance(a string) {
+func (cli *CLI) getBalance(a, nodeID string) {
 	if !CheckAddress(a) {
 		log.Panic("ERROR: Address is not valid")
 	}
-	bc := NewBlockchain(a)
+	bc := NewBlockchain(nodeID)
 	defer bc.db.Close()
+	utxoSet := UTXOSet{bc}
 
 	balance := 0
 	pubKeyHash := Base58Decode([]byte(a))
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := bc.FindUTXO(pubKeyHash)
+	UTXOs := utxoSet.FindUTXO(pubKeyHash)
 
 	for _, out := range UTXOs {
 		balance += out.V
@@ -44,6 +46,16 @@ func (cli *CLI) getBalance(a string) {
 	fmt.Printf("Balance of '%s': %d\n", a, balance)
 }
 
+// reindexUTXO rebuilds the UTXO set from the current chain
+func (cli *CLI) reindexUTXO(nodeID string) {
+	bc := NewBlockchain(nodeID)
+	defer bc.db.Close()
+	utxoSet := UTXOSet{bc}
+
+	utxoSet.Reindex()
+
+	fmt.Println("Done!")
+}
 
 func (cli *CLI) listAddresses() {
 	wallets, err := NewWallets()
@@ -57,8 +69,8 @@ func (cli *CLI) listAddresses() {
 	}
 }
 
-func (cli *CLI) printChain() {
-	bc := NewBlockchain("")
+func (cli *CLI) printChain(nodeID string) {
+	bc := NewBlockchain(nodeID)
 	defer bc.db.Close()
 
 	bci := bc.Iterator()
@@ -68,6 +80,7 @@ func (cli *CLI) printChain() {
 
 		fmt.Printf("============ Block %x ============\n", block.Hash)
 		fmt.Printf("Previous block: %x\n", block.PreHash)
+		fmt.Printf("Difficulty: %d\n", block.Difficulty)
 		pow := NewPOW(block)
 		fmt.Printf("PoW: %s\n\n", strconv.FormatBool(pow.Validate()))
 		for _, tx := range block.Transactions {
@@ -81,7 +94,36 @@ func (cli *CLI) printChain() {
 	}
 }
 
-func (cli *CLI) send(f, t string, m int) {
+// getProof prints a Merkle proof that the transaction identified by txID
+// is included in the chain, so a light client can verify it without
+// downloading the full block
+func (cli *CLI) getProof(txID, nodeID string) {
+	bc := NewBlockchain(nodeID)
+	defer bc.db.Close()
+
+	id, err := hex.DecodeString(txID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	block, err := bc.FindBlockContaining(id)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	path, sides, err := block.MerklePath(id)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Block:  %x\n", block.Hash)
+	fmt.Printf("Root:   %x\n", block.HashTransactions())
+	for i, sibling := range path {
+		fmt.Printf("Sibling %d: %x (right=%t)\n", i, sibling, sides[i])
+	}
+}
+
+func (cli *CLI) send(f, t string, m, fee int, nodeID string) {
 	if !CheckAddress(f) {
 		log.Panic("ERROR: Sender address is not valid")
 	}
@@ -89,12 +131,31 @@ func (cli *CLI) send(f, t string, m int) {
 		log.Panic("ERROR: Recipient address is not valid")
 	}
 
-	bc := NewBlockchain(f)
+	bc := NewBlockchain(nodeID)
 	defer bc.db.Close()
+	utxoSet := UTXOSet{bc}
+
+	tx := NewTransaction(f, t, m, fee, &utxoSet)
+
+	if nodeID == "" {
+		bc.MineBlock(f, []*Transaction{tx})
+		fmt.Println("Success!")
+		return
+	}
 
-	tx := NewTransaction(f, t, m, bc)
-	bc.Mine([]*Transaction{tx})
-	fmt.Println("Success!")
+	sendTx(KnownNodes[0], tx)
+	fmt.Println("Sent to the network!")
+}
+
+func (cli *CLI) startNode(port, minerAddress string) {
+	fmt.Printf("Starting node on port %s\n", port)
+	if minerAddress != "" {
+		if !CheckAddress(minerAddress) {
+			log.Panic("ERROR: Wrong miner address")
+		}
+		fmt.Println("Mining is on. Address to receive rewards:", minerAddress)
+	}
+	StartServer(port, minerAddress)
 }
 
 // CLI responsible for processing command line arguments
@@ -105,9 +166,12 @@ func (cli *CLI) printUsage() {
 	fmt.Println("  createblockchain/cb -a ADDRESS - Create a rootchain and send block reward to ADDRESS")
 	fmt.Println("  createwallet/cw - Generates a new key-pair and saves it into the wallet file")
 	fmt.Println("  getbalance/g -a ADDRESS - Get balance of ADDRESS")
+	fmt.Println("  getproof -t TXID - Print a Merkle proof that TXID is included in the chain")
 	fmt.Println("  listaddresses/l - Lists all addresses from the wallet file")
 	fmt.Println("  printchain/p - Print all the blocks of the blockchain")
-	fmt.Println("  send/s -f FROM -t TO -m AMOUNT - Send AMOUNT of coins from FROM address to TO")
+	fmt.Println("  reindexutxo - Rebuilds the UTXO set")
+	fmt.Println("  send/s -f FROM -t TO -m AMOUNT [-fee FEE] - Send AMOUNT of coins from FROM address to TO, optionally paying FEE to the miner")
+	fmt.Println("  startnode -port N [-miner ADDRESS] - Start a node and listen on port N; mine if -miner is set")
 }
 
 func (cli *CLI) checkArgs() {
@@ -121,18 +185,27 @@ func (cli *CLI) checkArgs() {
 func (cli *CLI) Run() {
 	cli.checkArgs()
 
+	nodeID := os.Getenv("NODE_ID")
+
 	createBCCli := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	getBalanceCli := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	createWalletCli := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	listAddressesCli := flag.NewFlagSet("listaddresses", flag.ExitOnError)
 	sendCli := flag.NewFlagSet("send", flag.ExitOnError)
 	printChainCli := flag.NewFlagSet("printchain", flag.ExitOnError)
+	reindexUTXOCli := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	getProofCli := flag.NewFlagSet("getproof", flag.ExitOnError)
+	startNodeCli := flag.NewFlagSet("startnode", flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCli.String("a", "", "The address to get balance for")
 	createBCAddress := createBCCli.String("a", "", "The address to send genesis block reward to")
 	from := sendCli.String("f", "", "Source wallet address")
 	to := sendCli.String("t", "", "Destination wallet address")
 	amount := sendCli.Int("m", 0, "Amount to send")
+	fee := sendCli.Int("fee", 0, "Fee to pay the miner that includes the transaction")
+	proofTXID := getProofCli.String("t", "", "The transaction ID to prove inclusion for")
+	startNodePort := startNodeCli.String("port", "", "The port to listen on")
+	startNodeMiner := startNodeCli.String("miner", "", "Mining reward address")
 
 	switch os.Args[1] {
 	case "getbalance":
@@ -171,6 +244,21 @@ func (cli *CLI) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "reindexutxo":
+		err := reindexUTXOCli.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getproof":
+		err := getProofCli.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "startnode":
+		err := startNodeCli.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	default:
 		cli.printUsage()
 		os.Exit(1)
@@ -181,7 +269,7 @@ func (cli *CLI) Run() {
 			getBalanceCli.Usage()
 			os.Exit(1)
 		}
-		cli.getBalance(*getBalanceAddress)
+		cli.getBalance(*getBalanceAddress, nodeID)
 	}
 
 	if createBCCli.Parsed() {
@@ -189,7 +277,7 @@ func (cli *CLI) Run() {
 			createBCCli.Usage()
 			os.Exit(1)
 		}
-		cli.createBC(*createBCAddress)
+		cli.createBC(*createBCAddress, nodeID)
 	}
 
 	if createWalletCli.Parsed() {
@@ -201,7 +289,7 @@ func (cli *CLI) Run() {
 	}
 
 	if printChainCli.Parsed() {
-		cli.printChain()
+		cli.printChain(nodeID)
 	}
 
 	if sendCli.Parsed() {
@@ -210,7 +298,27 @@ func (cli *CLI) Run() {
 			os.Exit(1)
 		}
 
-		cli.send(*from, *to, *amount)
+		cli.send(*from, *to, *amount, *fee, nodeID)
+	}
+
+	if reindexUTXOCli.Parsed() {
+		cli.reindexUTXO(nodeID)
+	}
+
+	if getProofCli.Parsed() {
+		if *proofTXID == "" {
+			getProofCli.Usage()
+			os.Exit(1)
+		}
+		cli.getProof(*proofTXID, nodeID)
+	}
+
+	if startNodeCli.Parsed() {
+		if *startNodePort == "" {
+			startNodeCli.Usage()
+			os.Exit(1)
+		}
+		cli.startNode(*startNodePort, *startNodeMiner)
 	}
 }
 
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+// MerkleTree represents a Merkle tree over a block's transaction hashes
+type MerkleTree struct {
+	RootNode *MerkleNode
+	Leaves   []*MerkleNode
+}
+
+// MerkleNode represents a Merkle tree node
+type MerkleNode struct {
+	Parent *MerkleNode
+	Left   *MerkleNode
+	Right  *MerkleNode
+	Data   []byte
+}
+
+// NewMerkleNode creates a new Merkle tree node
+func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
+	node := &MerkleNode{}
+
+	if left == nil && right == nil {
+		node.Data = data
+	} else {
+		hash := sha256.Sum256(append(left.Data, right.Data...))
+		node.Data = hash[:]
+	}
+
+	node.Left = left
+	node.Right = right
+	if left != nil {
+		left.Parent = node
+	}
+	if right != nil {
+		right.Parent = node
+	}
+
+	return node
+}
+
+// NewMerkleTree creates a new Merkle tree from a sequence of data, pairing
+// nodes level by level and duplicating the last node when a level is odd
+func NewMerkleTree(data [][]byte) *MerkleTree {
+	if len(data) == 0 {
+		data = append(data, []byte{})
+	}
+
+	var nodes []*MerkleNode
+	for _, d := range data {
+		nodes = append(nodes, NewMerkleNode(nil, nil, d))
+	}
+	leaves := nodes
+
+	for len(nodes) > 1 {
+		if len(nodes)%2 != 0 {
+			nodes = append(nodes, nodes[len(nodes)-1])
+		}
+
+		var level []*MerkleNode
+		for i := 0; i < len(nodes); i += 2 {
+			level = append(level, NewMerkleNode(nodes[i], nodes[i+1], nil))
+		}
+		nodes = level
+	}
+
+	return &MerkleTree{nodes[0], leaves}
+}
+
+// VerifyMerklePath recomputes the Merkle root from a transaction hash and its
+// proof path, and checks it matches root. The side flags indicate whether
+// the corresponding path entry is the left or the right sibling.
+func VerifyMerklePath(txHash, root []byte, path [][]byte, sides []bool) bool {
+	if len(path) != len(sides) {
+		return false
+	}
+
+	hash := txHash
+
+	for i, sibling := range path {
+		var sum [32]byte
+		if sides[i] {
+			sum = sha256.Sum256(append(append([]byte{}, hash...), sibling...))
+		} else {
+			sum = sha256.Sum256(append(append([]byte{}, sibling...), hash...))
+		}
+		hash = sum[:]
+	}
+
+	return bytes.Compare(hash, root) == 0
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+)
+
+const protocol = "tcp"
+const nodeVersion = 1
+const commandLength = 12
+
+// KnownNodes is the set of peers this node knows about; the first entry acts
+// as the seed node every other node dials into on startup
+var KnownNodes = []string{"localhost:3000"}
+
+// Version is exchanged right after connecting so peers learn each other's
+// chain height
+type Version struct {
+	Version    int
+	BestHeight int
+	AddrFrom   string
+}
+
+// GetBlocks asks a peer for the hashes of every block it knows about
+type GetBlocks struct {
+	AddrFrom string
+}
+
+// Inv advertises block or transaction hashes a peer can fetch with GetData
+type Inv struct {
+	AddrFrom string
+	Type     string // "block" or "tx"
+	Items    [][]byte
+}
+
+// GetData requests a single block or transaction from a peer
+type GetData struct {
+	AddrFrom string
+	Type     string
+	Id       []byte
+}
+
+// BlockMsg delivers a serialized Block
+type BlockMsg struct {
+	AddrFrom string
+	Block    []byte
+}
+
+// TxMsg delivers a serialized Transaction
+type TxMsg struct {
+	AddrFrom    string
+	Transaction []byte
+}
+
+func commandToBytes(command string) []byte {
+	var bytes [commandLength]byte
+
+	for i, c := range command {
+		bytes[i] = byte(c)
+	}
+
+	return bytes[:]
+}
+
+func bytesToCommand(bytes []byte) string {
+	var command []byte
+
+	for _, b := range bytes {
+		if b != 0x0 {
+			command = append(command, b)
+		}
+	}
+
+	return string(command)
+}
+
+func gobEncode(data interface{}) []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(data)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+// nodeIsKnownLocked is nodeIsKnown without locking stateMu, for callers that
+// already hold it
+func nodeIsKnownLocked(addr string) bool {
+	for _, node := range KnownNodes {
+		if node == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+func nodeIsKnown(addr string) bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	return nodeIsKnownLocked(addr)
+}
+
+// sendData opens a connection to addr and writes data; connection failures
+// just drop the peer from KnownNodes instead of propagating an error, since
+// gossip is best-effort
+func sendData(addr string, data []byte) {
+	conn, err := net.Dial(protocol, addr)
+	if err != nil {
+		fmt.Printf("%s is not available\n", addr)
+
+		stateMu.Lock()
+		var updatedNodes []string
+		for _, node := range KnownNodes {
+			if node != addr {
+				updatedNodes = append(updatedNodes, node)
+			}
+		}
+		KnownNodes = updatedNodes
+		stateMu.Unlock()
+
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(data)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+func sendVersion(addr string, bc *Blockchain) {
+	payload := gobEncode(Version{nodeVersion, bc.GetBestHeight(), nodeAddress})
+	request := append(commandToBytes("version"), payload...)
+
+	sendData(addr, request)
+}
+
+func sendGetBlocks(addr string) {
+	payload := gobEncode(GetBlocks{nodeAddress})
+	request := append(commandToBytes("getblocks"), payload...)
+
+	sendData(addr, request)
+}
+
+func sendInv(addr, kind string, items [][]byte) {
+	payload := gobEncode(Inv{nodeAddress, kind, items})
+	request := append(commandToBytes("inv"), payload...)
+
+	sendData(addr, request)
+}
+
+func sendGetData(addr, kind string, id []byte) {
+	payload := gobEncode(GetData{nodeAddress, kind, id})
+	request := append(commandToBytes("getdata"), payload...)
+
+	sendData(addr, request)
+}
+
+func sendBlock(addr string, b *Block) {
+	payload := gobEncode(BlockMsg{nodeAddress, b.Serialization()})
+	request := append(commandToBytes("block"), payload...)
+
+	sendData(addr, request)
+}
+
+func sendTx(addr string, tx *Transaction) {
+	payload := gobEncode(TxMsg{nodeAddress, tx.Serialize()})
+	request := append(commandToBytes("tx"), payload...)
+
+	sendData(addr, request)
+}
+
+func readCommand(conn net.Conn) (string, []byte, error) {
+	request, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(request) < commandLength {
+		return "", nil, errors.New("request is too short to contain a command")
+	}
+
+	command := bytesToCommand(request[:commandLength])
+
+	return command, request[commandLength:], nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"math/big"
+)
+
+const maxNonce = math.MaxInt64
+
+// POW represents a proof-of-work: a block is valid once hashing it (with a
+// nonce) produces a hash below the block's own target
+type POW struct {
+	block      *Block
+	target     *big.Int
+	merkleRoot []byte
+}
+
+// NewPOW builds a POW for block, deriving the target from block.Difficulty
+// (the number of leading zero bits the hash must have) rather than a
+// global constant, so each block carries the difficulty it was mined under.
+// The Merkle root is computed once here rather than in prepareData, since
+// block.Transactions doesn't change across nonce attempts (or re-validation)
+func NewPOW(block *Block) *POW {
+	target := big.NewInt(1)
+	target.Lsh(target, uint(256-block.Difficulty))
+
+	return &POW{block, target, block.HashTransactions()}
+}
+
+func intToBytes(n int64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(n))
+
+	return buf
+}
+
+func (pow *POW) prepareData(nonce int) []byte {
+	data := bytes.Join(
+		[][]byte{
+			pow.block.PreHash,
+			pow.merkleRoot,
+			intToBytes(pow.block.Time),
+			intToBytes(int64(pow.block.Difficulty)),
+			intToBytes(int64(nonce)),
+		},
+		[]byte{},
+	)
+
+	return data
+}
+
+// Run looks for a nonce that makes the block hash below the target
+func (pow *POW) Run() (int, []byte) {
+	var hashInt big.Int
+	var hash [32]byte
+	nonce := 0
+
+	for nonce < maxNonce {
+		data := pow.prepareData(nonce)
+		hash = sha256.Sum256(data)
+		hashInt.SetBytes(hash[:])
+
+		if hashInt.Cmp(pow.target) == -1 {
+			break
+		}
+		nonce++
+	}
+
+	return nonce, hash[:]
+}
+
+// Validate checks that the block's stored nonce satisfies its own
+// Difficulty, instead of a fixed global target
+func (pow *POW) Validate() bool {
+	var hashInt big.Int
+
+	data := pow.prepareData(pow.block.Nonce)
+	hash := sha256.Sum256(data)
+	hashInt.SetBytes(hash[:])
+
+	return hashInt.Cmp(pow.target) == -1
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+// nodeAddress is this node's own "host:port", used so peers know who sent
+// a message
+var nodeAddress string
+
+// miningAddress is non-empty when this node packages pooled transactions
+// into blocks; empty for a wallet-only node
+var miningAddress string
+
+// stateMu guards blocksInTransit, mempool and KnownNodes (network.go), all
+// of which are read and written from the per-connection goroutines spawned
+// in StartServer
+var stateMu sync.Mutex
+
+// blocksInTransit tracks block hashes requested from a peer during sync
+var blocksInTransit [][]byte
+
+// mempool accumulates transactions broadcast by peers until a miner node
+// packages them into a block
+var mempool = make(map[string]Transaction)
+
+// StartServer starts a node: it listens on port, joins the network by
+// announcing itself to the seed node, and serves incoming connections
+func StartServer(nodeID, minerAddress string) {
+	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
+	miningAddress = minerAddress
+
+	ln, err := net.Listen(protocol, nodeAddress)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer ln.Close()
+
+	bc := NewBlockchain(nodeID)
+
+	if nodeAddress != KnownNodes[0] {
+		sendVersion(KnownNodes[0], bc)
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Panic(err)
+		}
+		go handleConnection(conn, bc)
+	}
+}
+
+func handleConnection(conn net.Conn, bc *Blockchain) {
+	defer conn.Close()
+
+	command, payload, err := readCommand(conn)
+	if err != nil {
+		fmt.Println("Error reading command:", err)
+		return
+	}
+
+	fmt.Printf("Received %s command\n", command)
+
+	switch command {
+	case "version":
+		handleVersion(payload, bc)
+	case "getblocks":
+		handleGetBlocks(payload, bc)
+	case "inv":
+		handleInv(payload, bc)
+	case "getdata":
+		handleGetData(payload, bc)
+	case "block":
+		handleBlock(payload, bc)
+	case "tx":
+		handleTx(payload, bc)
+	default:
+		fmt.Println("Unknown command!")
+	}
+}
+
+func handleVersion(payload []byte, bc *Blockchain) {
+	var buff bytes.Buffer
+	var version Version
+
+	buff.Write(payload)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&version)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	stateMu.Lock()
+	if !nodeIsKnownLocked(version.AddrFrom) {
+		KnownNodes = append(KnownNodes, version.AddrFrom)
+	}
+	stateMu.Unlock()
+
+	myBestHeight := bc.GetBestHeight()
+	if myBestHeight < version.BestHeight {
+		sendGetBlocks(version.AddrFrom)
+	} else if myBestHeight > version.BestHeight {
+		sendVersion(version.AddrFrom, bc)
+	}
+}
+
+func handleGetBlocks(payload []byte, bc *Blockchain) {
+	var buff bytes.Buffer
+	var getBlocks GetBlocks
+
+	buff.Write(payload)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&getBlocks)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	hashes := bc.GetBlockHashes()
+	sendInv(getBlocks.AddrFrom, "block", hashes)
+}
+
+func handleInv(payload []byte, bc *Blockchain) {
+	var buff bytes.Buffer
+	var inv Inv
+
+	buff.Write(payload)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&inv)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Received inventory with %d %s(s)\n", len(inv.Items), inv.Type)
+
+	if inv.Type == "block" {
+		stateMu.Lock()
+		blocksInTransit = inv.Items
+		stateMu.Unlock()
+
+		blockHash := inv.Items[0]
+		sendGetData(inv.AddrFrom, "block", blockHash)
+
+		stateMu.Lock()
+		var newInTransit [][]byte
+		for _, b := range blocksInTransit {
+			if bytes.Compare(b, blockHash) != 0 {
+				newInTransit = append(newInTransit, b)
+			}
+		}
+		blocksInTransit = newInTransit
+		stateMu.Unlock()
+	}
+
+	if inv.Type == "tx" {
+		txID := inv.Items[0]
+
+		stateMu.Lock()
+		_, exists := mempool[string(txID)]
+		stateMu.Unlock()
+
+		if !exists {
+			sendGetData(inv.AddrFrom, "tx", txID)
+		}
+	}
+}
+
+func handleGetData(payload []byte, bc *Blockchain) {
+	var buff bytes.Buffer
+	var getData GetData
+
+	buff.Write(payload)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&getData)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if getData.Type == "block" {
+		block, err := bc.GetBlock(getData.Id)
+		if err != nil {
+			return
+		}
+
+		sendBlock(getData.AddrFrom, block)
+	}
+
+	if getData.Type == "tx" {
+		stateMu.Lock()
+		tx, exists := mempool[string(getData.Id)]
+		stateMu.Unlock()
+		if !exists {
+			return
+		}
+
+		sendTx(getData.AddrFrom, &tx)
+	}
+}
+
+func handleBlock(payload []byte, bc *Blockchain) {
+	var buff bytes.Buffer
+	var blockMsg BlockMsg
+
+	buff.Write(payload)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&blockMsg)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	block := Deserialization(blockMsg.Block)
+
+	if block.Difficulty < 1 || block.Difficulty > 255 {
+		fmt.Println("Rejected block: difficulty out of range")
+		return
+	}
+
+	if !NewPOW(block).Validate() {
+		fmt.Println("Rejected block: proof of work is invalid")
+		return
+	}
+
+	if !bytes.Equal(block.PreHash, bc.Hash) {
+		fmt.Println("Rejected block: does not extend the current tip")
+		return
+	}
+
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinbase() && !bc.VerifyTransaction(tx) {
+			fmt.Println("Rejected block: contains an invalid transaction")
+			return
+		}
+	}
+
+	bc.AddBlock(block)
+
+	fmt.Printf("Added block %x\n", block.Hash)
+
+	stateMu.Lock()
+	var nextHash []byte
+	hasNext := len(blocksInTransit) > 0
+	if hasNext {
+		nextHash = blocksInTransit[0]
+		blocksInTransit = blocksInTransit[1:]
+	}
+	stateMu.Unlock()
+
+	if hasNext {
+		sendGetData(blockMsg.AddrFrom, "block", nextHash)
+	}
+}
+
+func handleTx(payload []byte, bc *Blockchain) {
+	var buff bytes.Buffer
+	var txMsg TxMsg
+
+	buff.Write(payload)
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&txMsg)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	trans := DeserializeTransaction(txMsg.Transaction)
+
+	stateMu.Lock()
+	mempool[string(trans.Id)] = trans
+	nodes := append([]string{}, KnownNodes...)
+	poolSize := len(mempool)
+	stateMu.Unlock()
+
+	for _, node := range nodes {
+		if node != nodeAddress && node != txMsg.AddrFrom {
+			sendInv(node, "tx", [][]byte{trans.Id})
+		}
+	}
+
+	if miningAddress != "" && poolSize > 0 {
+		mineMempool(bc)
+	}
+}
+
+// mineMempool packages the pooled transactions that pass verification into
+// a block via MineBlock, mines it and broadcasts it to the network; only the
+// transactions the block includes are removed from the mempool
+func mineMempool(bc *Blockchain) {
+	stateMu.Lock()
+	pooled := make([]Transaction, 0, len(mempool))
+	for _, tx := range mempool {
+		pooled = append(pooled, tx)
+	}
+	stateMu.Unlock()
+
+	var txs []*Transaction
+	for i := range pooled {
+		if bc.VerifyTransaction(&pooled[i]) {
+			txs = append(txs, &pooled[i])
+		}
+	}
+
+	if len(txs) == 0 {
+		fmt.Println("All transactions are invalid! Waiting for new ones...")
+		return
+	}
+
+	newBlock := bc.MineBlock(miningAddress, txs)
+
+	stateMu.Lock()
+	for _, tx := range newBlock.Transactions {
+		delete(mempool, string(tx.Id))
+	}
+	nodes := append([]string{}, KnownNodes...)
+	stateMu.Unlock()
+
+	for _, node := range nodes {
+		if node != nodeAddress {
+			sendInv(node, "block", [][]byte{newBlock.Hash})
+		}
+	}
+}
@@ -84,6 +84,19 @@ func (trans Transaction) Serialize() []byte {
 	return encoded.Bytes()
 }
 
+// DeserializeTransaction deserializes a Transaction
+func DeserializeTransaction(d []byte) Transaction {
+	var trans Transaction
+
+	dec := gob.NewDecoder(bytes.NewReader(d))
+	err := dec.Decode(&trans)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return trans
+}
+
 // Hash returns the hash of the Transaction
 func (trans *Transaction) Hash() []byte {
 	var hash [32]byte
@@ -212,22 +225,26 @@ func (trans *Transaction) Verify(prevTrans map[string]Transaction) bool {
 	return true
 }
 
-// NewCoinTrans creates a new coinbase transaction
-func NewCoinTrans(to, data string) *Transaction {
+// NewCoinTrans creates a new coinbase transaction; the reward is the block
+// subsidy plus any fees collected from the transactions it accompanies
+func NewCoinTrans(to, data string, fees int) *Transaction {
 	if data == "" {
 		data = fmt.Sprintf("Reward to '%s'", to)
 	}
 
 	in := TransInput{[]byte{}, -1, nil, []byte(data)}
-	out := NewTransOutput(subsidy, to)
+	out := NewTransOutput(subsidy+fees, to)
 	trans := Transaction{nil, []TransInput{in}, []TransOutput{*out}}
 	trans.Id = trans.Hash()
 
 	return &trans
 }
 
-// NewTransaction creates a new transaction
-func NewTransaction(from, to string, amount int, bc *Blockchain) *Transaction {
+// NewTransaction creates a new transaction; if fee is greater than zero,
+// the sender's inputs must cover amount+fee and the difference is left
+// unassigned to any output, letting the miner that includes the transaction
+// claim it via the coinbase
+func NewTransaction(from, to string, amount, fee int, utxoSet *UTXOSet) *Transaction {
 	var inputs []TransInput
 	var outputs []TransOutput
 
@@ -237,9 +254,9 @@ func NewTransaction(from, to string, amount int, bc *Blockchain) *Transaction {
 	}
 	wallet := wallets.GetWallet(from)
 	pubKH := HashPubKey(wallet.PubK)
-	acc, validOutputs := bc.FindOutputs(pubKH, amount)
+	acc, validOutputs := utxoSet.FindSpendableOutputs(pubKH, amount+fee)
 
-	if acc < amount {
+	if acc < amount+fee {
 		log.Panic("ERROR: Not enough funds")
 	}
 
@@ -258,13 +275,34 @@ func NewTransaction(from, to string, amount int, bc *Blockchain) *Transaction {
 
 	// Build a list of outputs
 	outputs = append(outputs, *NewTransOutput(amount, to))
-	if acc > amount {
-		outputs = append(outputs, *NewTransOutput(acc-amount, from)) // a change
+	if acc > amount+fee {
+		outputs = append(outputs, *NewTransOutput(acc-amount-fee, from)) // a change
 	}
 
 	trans := Transaction{nil, inputs, outputs}
 	trans.Id = trans.Hash()
-	bc.SignTransaction(&trans, wallet.PriK)
+	utxoSet.Blockchain.SignTransaction(&trans, wallet.PriK)
 
 	return &trans
 }
+
+// CalculateFee returns the difference between the transaction's input sum
+// and output sum; prevTrans must contain every transaction referenced by Vin
+func (trans *Transaction) CalculateFee(prevTrans map[string]Transaction) int {
+	if trans.IsCoinbase() {
+		return 0
+	}
+
+	inSum := 0
+	for _, vin := range trans.Vin {
+		prevTran := prevTrans[hex.EncodeToString(vin.Id)]
+		inSum += prevTran.Vout[vin.Vout].V
+	}
+
+	outSum := 0
+	for _, vout := range trans.Vout {
+		outSum += vout.V
+	}
+
+	return inSum - outSum
+}
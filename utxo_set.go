@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"log"
+
+	"github.com/boltdb/bolt"
+)
+
+const utxoBucket = "chainstate"
+
+// UTXOSet represents UTXO set stored in a second bolt bucket, indexed by
+// transaction ID, so balance and spend queries don't have to walk the chain
+type UTXOSet struct {
+	Blockchain *Blockchain
+}
+
+// Reindex rebuilds the UTXO set from scratch by walking the chain once
+func (u UTXOSet) Reindex() {
+	db := u.Blockchain.db
+	bucketName := []byte(utxoBucket)
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(bucketName)
+		if err != nil && err != bolt.ErrBucketNotFound {
+			log.Panic(err)
+		}
+
+		_, err = tx.CreateBucket(bucketName)
+		if err != nil {
+			log.Panic(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	UTXO := u.Blockchain.FindAllUTXO()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+
+		for txID, outs := range UTXO {
+			key, err := hex.DecodeString(txID)
+			if err != nil {
+				log.Panic(err)
+			}
+
+			err = b.Put(key, serializeOutputs(outs))
+			if err != nil {
+				log.Panic(err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// Update updates the UTXO set with transactions from a newly mined block:
+// spent outpoints referenced by each Vin are removed and new Vouts are added
+func (u UTXOSet) Update(block *Block) {
+	db := u.Blockchain.db
+
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+
+		for _, trans := range block.Transactions {
+			if trans.IsCoinbase() == false {
+				for _, vin := range trans.Vin {
+					updatedOuts := []TransOutput{}
+					outsBytes := b.Get(vin.Id)
+					outs := deserializeOutputs(outsBytes)
+
+					for outIdx, out := range outs {
+						if outIdx != vin.Vout {
+							updatedOuts = append(updatedOuts, out)
+						}
+					}
+
+					if len(updatedOuts) == 0 {
+						err := b.Delete(vin.Id)
+						if err != nil {
+							log.Panic(err)
+						}
+					} else {
+						err := b.Put(vin.Id, serializeOutputs(updatedOuts))
+						if err != nil {
+							log.Panic(err)
+						}
+					}
+				}
+			}
+
+			var newOutputs []TransOutput
+			newOutputs = append(newOutputs, trans.Vout...)
+
+			err := b.Put(trans.Id, serializeOutputs(newOutputs))
+			if err != nil {
+				log.Panic(err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// FindSpendableOutputs finds and returns unspent outputs to reference in inputs
+func (u UTXOSet) FindSpendableOutputs(pubKH []byte, amount int) (int, map[string][]int) {
+	unspentOutputs := make(map[string][]int)
+	accumulated := 0
+	db := u.Blockchain.db
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			txID := hex.EncodeToString(k)
+			outs := deserializeOutputs(v)
+
+			for outIdx, out := range outs {
+				if out.IsLockedWithKey(pubKH) && accumulated < amount {
+					accumulated += out.V
+					unspentOutputs[txID] = append(unspentOutputs[txID], outIdx)
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return accumulated, unspentOutputs
+}
+
+// FindUTXO finds UTXO for a public key hash
+func (u UTXOSet) FindUTXO(pubKH []byte) []TransOutput {
+	var UTXOs []TransOutput
+	db := u.Blockchain.db
+
+	err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(utxoBucket))
+		c := b.Cursor()
+
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			outs := deserializeOutputs(v)
+
+			for _, out := range outs {
+				if out.IsLockedWithKey(pubKH) {
+					UTXOs = append(UTXOs, out)
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return UTXOs
+}
+
+// FindAllUTXO walks the whole chain once and returns every unspent output,
+// keyed by transaction ID; used to (re)build the UTXO set
+func (bc *Blockchain) FindAllUTXO() map[string][]TransOutput {
+	UTXO := make(map[string][]TransOutput)
+	spentTXOs := make(map[string][]int)
+	bci := bc.Iterator()
+
+	for {
+		block := bci.Next()
+
+		for _, trans := range block.Transactions {
+			txID := hex.EncodeToString(trans.Id)
+
+		Outputs:
+			for outIdx, out := range trans.Vout {
+				if spentTXOs[txID] != nil {
+					for _, spentOutIdx := range spentTXOs[txID] {
+						if spentOutIdx == outIdx {
+							continue Outputs
+						}
+					}
+				}
+
+				UTXO[txID] = append(UTXO[txID], out)
+			}
+
+			if trans.IsCoinbase() == false {
+				for _, in := range trans.Vin {
+					inTxID := hex.EncodeToString(in.Id)
+					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Vout)
+				}
+			}
+		}
+
+		if len(block.PreHash) == 0 {
+			break
+		}
+	}
+
+	return UTXO
+}
+
+func serializeOutputs(outs []TransOutput) []byte {
+	var buff bytes.Buffer
+
+	enc := gob.NewEncoder(&buff)
+	err := enc.Encode(outs)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return buff.Bytes()
+}
+
+func deserializeOutputs(d []byte) []TransOutput {
+	var outs []TransOutput
+
+	dec := gob.NewDecoder(bytes.NewReader(d))
+	err := dec.Decode(&outs)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return outs
+}